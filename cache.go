@@ -0,0 +1,363 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// cacheDir returns the root of the on-disk image cache, honoring
+// XDG_CACHE_HOME and falling back to ~/.cache/mini_container.
+func cacheDir() (string, error) {
+	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
+		return filepath.Join(xdg, "mini_container"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("find home directory: %w", err)
+	}
+	return filepath.Join(home, ".cache", "mini_container"), nil
+}
+
+// refDirName turns an image reference into a filesystem-safe path segment.
+func refDirName(ref string) string {
+	replacer := strings.NewReplacer("/", "_", ":", "_", "@", "_")
+	return replacer.Replace(ref)
+}
+
+// resolveRootfs returns an unpacked rootfs directory for ref along with the
+// image's declared runtime config (Entrypoint/Cmd/Env/WorkingDir/User), and
+// reuses the on-disk cache when the image's manifest digest is already
+// present unless noCache forces a re-fetch. It replaces the old
+// always-download rootfs().
+func resolveRootfs(ref string, noCache bool) (string, *v1.ConfigFile, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return "", nil, fmt.Errorf("parse image reference %q: %w", ref, err)
+	}
+
+	img, err := remote.Image(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("fetch manifest for %s: %w", ref, err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", nil, fmt.Errorf("compute manifest digest for %s: %w", ref, err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return "", nil, fmt.Errorf("fetch image config for %s: %w", ref, err)
+	}
+
+	cache, err := cacheDir()
+	if err != nil {
+		return "", nil, err
+	}
+	rootfsDir := filepath.Join(cache, "images", refDirName(ref), digest.Hex, "rootfs")
+
+	if !noCache {
+		if _, err := os.Stat(rootfsDir); err == nil {
+			fmt.Printf("using cached rootfs for %s@%s\n", ref, digest)
+			return rootfsDir, cfg, nil
+		}
+	}
+
+	fmt.Printf("unpacking %s@%s\n", ref, digest)
+	layers, err := img.Layers()
+	if err != nil {
+		return "", nil, fmt.Errorf("list layers for %s: %w", ref, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rootfsDir), 0755); err != nil {
+		return "", nil, fmt.Errorf("create %s: %w", filepath.Dir(rootfsDir), err)
+	}
+	fresh, err := os.MkdirTemp(filepath.Dir(rootfsDir), "rootfs-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("create temp rootfs dir: %w", err)
+	}
+
+	var usedBlobs []string
+	for _, l := range layers {
+		blob, err := fetchLayerBlob(cache, l)
+		if err != nil {
+			os.RemoveAll(fresh)
+			return "", nil, err
+		}
+		usedBlobs = append(usedBlobs, filepath.Base(blob))
+		if err := func() error {
+			f, err := os.Open(blob)
+			if err != nil {
+				return fmt.Errorf("open cached blob %s: %w", blob, err)
+			}
+			defer f.Close()
+			return untarLayer(f, fresh)
+		}(); err != nil {
+			os.RemoveAll(fresh)
+			return "", nil, err
+		}
+	}
+
+	os.RemoveAll(rootfsDir)
+	if err := os.Rename(fresh, rootfsDir); err != nil {
+		os.RemoveAll(fresh)
+		return "", nil, fmt.Errorf("install rootfs at %s: %w", rootfsDir, err)
+	}
+
+	// Record which blobs this image depends on so prune can tell live blobs
+	// from orphaned ones.
+	manifestDir := filepath.Dir(rootfsDir)
+	layersFile := filepath.Join(manifestDir, "layers.txt")
+	if err := os.WriteFile(layersFile, []byte(strings.Join(usedBlobs, "\n")+"\n"), 0644); err != nil {
+		return "", nil, fmt.Errorf("write %s: %w", layersFile, err)
+	}
+
+	return rootfsDir, cfg, nil
+}
+
+// fetchLayerBlob returns the path to l's compressed blob in the content-
+// addressed cache, downloading it if it isn't already there. A per-digest
+// flock keeps concurrent invocations from racing on the same blob.
+func fetchLayerBlob(cache string, l v1.Layer) (string, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return "", fmt.Errorf("compute layer digest: %w", err)
+	}
+
+	blobDir := filepath.Join(cache, "blobs", digest.Algorithm)
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return "", fmt.Errorf("create %s: %w", blobDir, err)
+	}
+	final := filepath.Join(blobDir, digest.Hex)
+
+	unlock, err := lockBlob(final)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(final); err == nil {
+		return final, nil
+	}
+
+	rc, err := l.Compressed()
+	if err != nil {
+		return "", fmt.Errorf("open layer %s: %w", digest, err)
+	}
+	defer rc.Close()
+
+	partial := final + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return "", fmt.Errorf("create %s: %w", partial, err)
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		os.Remove(partial)
+		return "", fmt.Errorf("download layer %s: %w", digest, err)
+	}
+	f.Close()
+
+	if err := os.Rename(partial, final); err != nil {
+		os.Remove(partial)
+		return "", fmt.Errorf("install blob %s: %w", final, err)
+	}
+	return final, nil
+}
+
+// lockBlob takes an exclusive flock on path+".lock", creating it if needed,
+// and returns a func to release it.
+func lockBlob(path string) (unlock func(), err error) {
+	lockPath := path + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file %s: %w", lockPath, err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("flock %s: %w", lockPath, err)
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// tryLockFile takes a non-blocking exclusive flock on path, which must
+// already exist. It reports ok=false (rather than an error) when the lock
+// is currently held by someone else, so callers can skip whatever they were
+// about to do instead of treating contention as a failure.
+func tryLockFile(path string) (ok bool, unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return false, nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return false, nil, nil
+		}
+		return false, nil, fmt.Errorf("flock %s: %w", path, err)
+	}
+	return true, func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// untarLayer gunzips and extracts a single cached (compressed) layer blob,
+// honoring OCI whiteout conventions: ".wh.<name>" deletes <name>, and
+// ".wh..wh..opq" clears a directory's existing contents before the rest of
+// the layer is applied.
+func untarLayer(r io.Reader, dst string) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("gunzip layer: %w", err)
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dir, base := filepath.Split(h.Name)
+		if base == ".wh..wh..opq" {
+			target := filepath.Join(dst, dir)
+			entries, _ := os.ReadDir(target)
+			for _, e := range entries {
+				os.RemoveAll(filepath.Join(target, e.Name()))
+			}
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			target := filepath.Join(dst, dir, strings.TrimPrefix(base, ".wh."))
+			os.RemoveAll(target)
+			continue
+		}
+
+		path := filepath.Join(dst, h.Name)
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, os.FileMode(h.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			os.Remove(path) // layers may replace a file with a different mode
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(h.Mode))
+			if err != nil {
+				return fmt.Errorf("create %s: %w", path, err)
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			f.Close()
+		case tar.TypeLink:
+			os.Remove(path)
+			if err := os.Link(filepath.Join(dst, h.Linkname), path); err != nil {
+				return fmt.Errorf("link %s: %w", path, err)
+			}
+		case tar.TypeSymlink:
+			os.Remove(path)
+			if err := os.Symlink(h.Linkname, path); err != nil {
+				return fmt.Errorf("symlink %s: %w", path, err)
+			}
+		}
+	}
+}
+
+// removeIfUnlocked removes target only after confirming lockPath isn't
+// currently flock'd by a concurrent fetchLayerBlob, so prune can't delete a
+// lock file (or the partial download it guards) out from under an
+// in-flight download - which would let a fresh invocation open a new inode
+// at the same path and acquire it immediately, splitting the lock.
+func removeIfUnlocked(lockPath, target string) error {
+	if _, err := os.Stat(lockPath); err != nil {
+		// No lock file to contend with; nothing is guarding target.
+		return os.Remove(target)
+	}
+
+	ok, unlock, err := tryLockFile(lockPath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Printf("skipping %s: locked by another invocation\n", target)
+		return nil
+	}
+	defer unlock()
+
+	fmt.Printf("removing %s\n", target)
+	return os.Remove(target)
+}
+
+// prune implements "mini_container prune": it walks every cached image's
+// layers.txt to find blobs still referenced by a cached rootfs, then
+// deletes any blob in the store that isn't referenced by anything, plus any
+// ".partial" leftovers from interrupted downloads.
+func prune() error {
+	cache, err := cacheDir()
+	if err != nil {
+		return err
+	}
+
+	referenced := map[string]bool{}
+	imagesRoot := filepath.Join(cache, "images")
+	filepath.Walk(imagesRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Base(path) != "layers.txt" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line != "" {
+				referenced[line] = true
+			}
+		}
+		return nil
+	})
+
+	blobRoot := filepath.Join(cache, "blobs")
+	return filepath.Walk(blobRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name := filepath.Base(path)
+
+		// A ".partial" file is guarded by its final blob's lock, not its
+		// own; find that lock so we don't race an in-flight download.
+		if strings.HasSuffix(name, ".partial") {
+			lockPath := strings.TrimSuffix(path, ".partial") + ".lock"
+			return removeIfUnlocked(lockPath, path)
+		}
+		if strings.HasSuffix(name, ".lock") {
+			return removeIfUnlocked(path, path)
+		}
+		if !referenced[name] {
+			lockPath := path + ".lock"
+			return removeIfUnlocked(lockPath, path)
+		}
+		return nil
+	})
+}
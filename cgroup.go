@@ -0,0 +1,187 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// limits holds the resource caps to apply to a container's cgroup. A zero
+// value for a field means "don't set this limit".
+type limits struct {
+	MemoryBytes int64   // memory.max
+	CPUs        float64 // translated into cpu.max's "<quota> <period>"
+	Pids        int64   // pids.max
+}
+
+const cpuPeriod = 100000 // microseconds; matches the common 100ms default
+
+// isCgroupV2 reports whether the host uses the unified (v2) cgroup
+// hierarchy, which is the only one this package knows how to target.
+func isCgroupV2() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// applyLimits creates a cgroup for name, applies limits to it, and adds pid
+// to it. It returns a cleanup func that removes the cgroup; callers should
+// defer it once the container has exited.
+func applyLimits(name string, pid int, limits limits) (cleanup func(), err error) {
+	if !isCgroupV2() {
+		return nil, fmt.Errorf("cgroup v2 (unified hierarchy) not found at %s; this host is v1-only", cgroupRoot)
+	}
+
+	base, err := cgroupBase()
+	if err != nil {
+		return nil, err
+	}
+
+	var controllers []string
+	writes := map[string]string{}
+	if limits.MemoryBytes > 0 {
+		controllers = append(controllers, "memory")
+		writes["memory.max"] = strconv.FormatInt(limits.MemoryBytes, 10)
+	}
+	if limits.CPUs > 0 {
+		controllers = append(controllers, "cpu")
+		quota := int64(limits.CPUs * cpuPeriod)
+		writes["cpu.max"] = fmt.Sprintf("%d %d", quota, cpuPeriod)
+	}
+	if limits.Pids > 0 {
+		controllers = append(controllers, "pids")
+		writes["pids.max"] = strconv.FormatInt(limits.Pids, 10)
+	}
+
+	// A cgroup only gets memory.max/cpu.max/pids.max once its *parent* has
+	// enabled that controller in its own cgroup.subtree_control. mini_container
+	// is a parent of the leaf we're about to create, so enable at both levels:
+	// base -> mini_container, and mini_container -> <name>.
+	mcDir := filepath.Join(base, "mini_container")
+	if err := os.MkdirAll(mcDir, 0755); err != nil {
+		return nil, fmt.Errorf("create %s: %w", mcDir, err)
+	}
+	if err := enableControllers(base, controllers); err != nil {
+		return nil, err
+	}
+	if err := enableControllers(mcDir, controllers); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(mcDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create cgroup %s: %w", dir, err)
+	}
+	cleanup = func() { os.Remove(dir) }
+
+	for file, value := range writes {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("write %s=%s: %w", file, value, err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("add pid %d to cgroup: %w", pid, err)
+	}
+
+	return cleanup, nil
+}
+
+// enableControllers enables each of controllers in dir/cgroup.subtree_control
+// (skipping any already enabled), so the controller's resource-control files
+// become available in dir's children.
+func enableControllers(dir string, controllers []string) error {
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(dir, "cgroup.subtree_control")
+	current, _ := os.ReadFile(path)
+	enabled := map[string]bool{}
+	for _, c := range strings.Fields(string(current)) {
+		enabled[c] = true
+	}
+
+	var toEnable []string
+	for _, c := range controllers {
+		if !enabled[c] {
+			toEnable = append(toEnable, "+"+c)
+		}
+	}
+	if len(toEnable) == 0 {
+		return nil
+	}
+
+	if err := os.WriteFile(path, []byte(strings.Join(toEnable, " ")), 0644); err != nil {
+		return fmt.Errorf("enable %s in %s: %w", strings.Join(toEnable, ","), path, err)
+	}
+	return nil
+}
+
+// cgroupBase returns the directory under which this process is allowed to
+// create sub-cgroups: the real root for a privileged process, or the
+// caller's delegated slice (as set up by systemd --user) when rootless.
+func cgroupBase() (string, error) {
+	if os.Getuid() == 0 {
+		return cgroupRoot, nil
+	}
+
+	return delegatedSlice()
+}
+
+// parseBytes parses a size like "128M" or "1.5G" (binary, 1024-based) into
+// a byte count, for the -memory flag.
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	units := map[byte]float64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	suffix := s[len(s)-1]
+	if suffix >= 'a' && suffix <= 'z' {
+		suffix -= 'a' - 'A'
+	}
+	numPart := s
+	mult := 1.0
+	if m, ok := units[suffix]; ok {
+		mult = m
+		numPart = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(numPart, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	return int64(n * mult), nil
+}
+
+// delegatedSlice locates the user's delegated cgroup, e.g.
+// /sys/fs/cgroup/user.slice/user-1000.slice/user@1000.service, by reading
+// our own cgroup membership out of /proc/self/cgroup.
+func delegatedSlice() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("read /proc/self/cgroup: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format is "<hierarchy-id>:<controllers>:<path>"; v2 entries have
+		// an empty controller list ("0::/path").
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) == 3 && parts[0] == "0" && parts[1] == "" {
+			return filepath.Join(cgroupRoot, parts[2]), nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 entry found in /proc/self/cgroup")
+}
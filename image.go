@@ -0,0 +1,246 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// execSpec is everything the child needs to know about what to run and how
+// its environment should look, derived from the image's v1.Config and any
+// -entrypoint/-workdir/-user/-env/positional-args overrides. It travels from
+// parent to child as a base64-encoded JSON blob passed as an extra argv
+// entry, since the child is a fresh exec of /proc/self/exe.
+type execSpec struct {
+	Env        []string
+	Entrypoint []string
+	Cmd        []string
+	WorkingDir string
+	User       string
+}
+
+// buildExecSpec merges the image's declared config with the CLI overrides.
+// An empty override leaves the image's value in place; overrideArgs (the
+// positional args after "--") replaces Cmd entirely, matching how Cmd is
+// meant to be overridable on the OCI image spec.
+func buildExecSpec(cfg *v1.Config, entrypoint, workdir, user string, extraEnv, overrideArgs []string) execSpec {
+	spec := execSpec{
+		Env:        mergeEnv(cfg.Env, extraEnv),
+		Entrypoint: cfg.Entrypoint,
+		Cmd:        cfg.Cmd,
+		WorkingDir: cfg.WorkingDir,
+		User:       cfg.User,
+	}
+	if entrypoint != "" {
+		spec.Entrypoint = strings.Fields(entrypoint)
+	}
+	if workdir != "" {
+		spec.WorkingDir = workdir
+	}
+	if user != "" {
+		spec.User = user
+	}
+	if len(overrideArgs) > 0 {
+		spec.Cmd = overrideArgs
+	}
+	if spec.WorkingDir == "" {
+		spec.WorkingDir = "/"
+	}
+	return spec
+}
+
+// mergeEnv overlays extraEnv ("-env KEY=VAL" overrides) onto the image's
+// declared env. Both getenv(3) and our own resolvePath PATH scan resolve
+// duplicate keys by taking the first match, so overrides must come before
+// any base entry they replace - not just be appended after it.
+func mergeEnv(base, extraEnv []string) []string {
+	overridden := make(map[string]bool, len(extraEnv))
+	for _, kv := range extraEnv {
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			overridden[kv[:i]] = true
+		}
+	}
+
+	merged := append([]string{}, extraEnv...)
+	for _, kv := range base {
+		i := strings.IndexByte(kv, '=')
+		if i >= 0 && overridden[kv[:i]] {
+			continue
+		}
+		merged = append(merged, kv)
+	}
+	return merged
+}
+
+// encodeExecSpec serializes spec for passing across the exec boundary.
+func encodeExecSpec(spec execSpec) (string, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("encode exec spec: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// decodeExecSpec is the child-side counterpart of encodeExecSpec.
+func decodeExecSpec(s string) (execSpec, error) {
+	var spec execSpec
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return spec, fmt.Errorf("decode exec spec: %w", err)
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return spec, fmt.Errorf("unmarshal exec spec: %w", err)
+	}
+	return spec, nil
+}
+
+// argv returns the full command to exec inside the container: the image's
+// (possibly overridden) entrypoint followed by its command/args.
+func (s execSpec) argv() []string {
+	argv := append(append([]string{}, s.Entrypoint...), s.Cmd...)
+	if len(argv) == 0 {
+		argv = []string{"/bin/sh", "-i"}
+	}
+	return argv
+}
+
+// resolvePath turns a bare command name (e.g. "sh") into an absolute path
+// by searching PATH as found in env, since syscall.Exec (unlike os/exec)
+// doesn't do PATH lookup itself. A name that's already a path is returned
+// unchanged.
+func resolvePath(name string, env []string) (string, error) {
+	if strings.ContainsRune(name, '/') {
+		return name, nil
+	}
+
+	path := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			path = strings.TrimPrefix(kv, "PATH=")
+			break
+		}
+	}
+
+	for _, dir := range strings.Split(path, ":") {
+		if dir == "" {
+			continue
+		}
+		candidate := dir + "/" + name
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%q not found in PATH", name)
+}
+
+// resolveUser parses a User spec of the form "uid", "uid:gid", "name", or
+// "name:group" and resolves names against /etc/passwd and /etc/group inside
+// the (already pivoted-into) container rootfs at root "/".
+func resolveUser(spec string) (uid, gid int, err error) {
+	if spec == "" {
+		return 0, 0, nil
+	}
+
+	name, group, hasGroup := spec, "", false
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, group, hasGroup = spec[:i], spec[i+1:], true
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		uid, gid = n, n
+	} else {
+		u, err := lookupPasswd(name)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, gid = u.uid, u.gid
+	}
+
+	if hasGroup {
+		if n, err := strconv.Atoi(group); err == nil {
+			gid = n
+		} else {
+			g, err := lookupGroup(group)
+			if err != nil {
+				return 0, 0, err
+			}
+			gid = g
+		}
+	}
+	return uid, gid, nil
+}
+
+type passwdEntry struct {
+	uid, gid int
+}
+
+// lookupPasswd finds name's uid/gid in /etc/passwd.
+func lookupPasswd(name string) (passwdEntry, error) {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return passwdEntry{}, fmt.Errorf("open /etc/passwd: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 4 || fields[0] != name {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			continue
+		}
+		return passwdEntry{uid, gid}, nil
+	}
+	return passwdEntry{}, fmt.Errorf("no such user %q in /etc/passwd", name)
+}
+
+// lookupGroup finds name's gid in /etc/group.
+func lookupGroup(name string) (int, error) {
+	f, err := os.Open("/etc/group")
+	if err != nil {
+		return 0, fmt.Errorf("open /etc/group: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		return gid, nil
+	}
+	return 0, fmt.Errorf("no such group %q in /etc/group", name)
+}
+
+// envList is a repeatable -env KEY=VAL flag.Value.
+type envList []string
+
+func (e *envList) String() string { return strings.Join(*e, ",") }
+
+func (e *envList) Set(kv string) error {
+	if !strings.Contains(kv, "=") {
+		return fmt.Errorf("-env expects KEY=VAL, got %q", kv)
+	}
+	*e = append(*e, kv)
+	return nil
+}
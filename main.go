@@ -3,22 +3,16 @@
 package main
 
 import (
-	"archive/tar"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strconv"
 	"syscall"
-	"time"
 
 	"golang.org/x/sys/unix"
-
-	"github.com/google/go-containerregistry/pkg/name"
-	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
 // must is a helper function that panics on error
@@ -28,132 +22,143 @@ func must(e error) {
 	}
 }
 
-// rootfs downloads an OCI image and returns the unpacked directory path
-// Always downloads fresh (no caching)
-func rootfs(ref string) string {
-	// Parse the image reference (e.g., "alpine:latest")
-	r, err := name.ParseReference(ref)
-	must(err)
-
-	// Create a unique temporary directory for this run
-	tmpDir := fmt.Sprintf("/tmp/rootfs-%d", time.Now().UnixNano())
-	must(os.MkdirAll(tmpDir, 0755))
-
-	fmt.Printf("Downloading and unpacking %s to %s\n", ref, tmpDir)
-
-	// Download the image and unpack it
-	img, err := remote.Image(r)
-	must(err)
-	must(unpack(img, tmpDir))
-	return tmpDir
-}
+// child runs the containerized process with the new namespaces
+// This function executes inside the isolated container environment
+func child(rootfs, encodedSpec string) {
+	// Wait for the parent to finish any host-side namespace setup (e.g.
+	// moving the veth peer into our netns) before touching interfaces.
+	sync := os.NewFile(3, "sync")
+	io.ReadAll(sync)
+	sync.Close()
 
-// unpack extracts all layers of an OCI image to the destination directory
-func unpack(img v1.Image, dst string) error {
-	layers, err := img.Layers()
-	if err != nil {
-		return err
+	if cidr := os.Getenv("MC_CIDR"); cidr != "" {
+		must(configureChildNetwork(cidr))
 	}
 
-	// Extract each layer in order
-	for _, l := range layers {
-		rc, err := l.Uncompressed()
-		if err != nil {
-			return err
-		}
-		if err := untar(rc, dst); err != nil {
-			rc.Close()
-			return err
-		}
-		rc.Close()
-	}
-	return nil
-}
+	// Set a friendly hostname for the container
+	must(unix.Sethostname([]byte("shadman-lab")))
 
-// untar extracts a tar stream to the destination directory
-// This is a pure Go implementation that handles the most common tar entry types
-func untar(r io.Reader, dst string) error {
-	tr := tar.NewReader(r)
-	for {
-		h, err := tr.Next()
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			return err
-		}
+	// Give the container a proper /dev, /dev/pts, /sys and /tmp and pivot
+	// into it, instead of chrooting with nothing but /proc mounted.
+	rootless := os.Getenv("MC_ROOTLESS") != ""
+	must(setup(rootfs, rootless))
 
-		path := filepath.Join(dst, h.Name)
-
-		switch h.Typeflag {
-		case tar.TypeDir:
-			must(os.MkdirAll(path, os.FileMode(h.Mode)))
-		case tar.TypeReg:
-			must(os.MkdirAll(filepath.Dir(path), 0755))
-			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, os.FileMode(h.Mode))
-			must(err)
-			if _, err := io.Copy(f, tr); err != nil {
-				f.Close()
-				return err
-			}
-			f.Close()
-		case tar.TypeLink:
-			// Hard link within the image
-			must(os.Link(filepath.Join(dst, h.Linkname), path))
-		case tar.TypeSymlink:
-			must(os.Symlink(h.Linkname, path))
-		}
+	// Detach from the host's session and make the PTY slave passed down via
+	// ExtraFiles our controlling terminal, so the shell gets real job
+	// control, window resize, and ^C handling instead of inherited raw fds.
+	if _, err := unix.Setsid(); err != nil {
+		must(err)
 	}
-}
-
-// child runs the containerized process with the new namespaces
-// This function executes inside the isolated container environment
-func child(rootfs string) {
-	// Set a friendly hostname for the container
-	must(unix.Sethostname([]byte("shadman-lab")))
+	must(becomeController(os.NewFile(4, "pty-slave")))
 
-	// Mount /proc filesystem inside the rootfs before chroot
-	// This is necessary because /proc won't be available after chroot
-	procPath := filepath.Join(rootfs, "proc")
-	must(os.MkdirAll(procPath, 0755))
-	must(unix.Mount("proc", procPath, "proc",
-		uintptr(unix.MS_NOSUID|unix.MS_NOEXEC|unix.MS_NODEV), ""))
+	spec, err := decodeExecSpec(encodedSpec)
+	must(err)
 
-	// Use chroot instead of pivot_root for simplicity
-	// chroot is easier to use and sufficient for basic containerization
-	// It changes the root directory for the current process and its children
-	must(unix.Chroot(rootfs))
+	must(os.Chdir(spec.WorkingDir))
 
-	// Change to the new root directory
-	must(unix.Chdir("/"))
+	uid, gid, err := resolveUser(spec.User)
+	must(err)
+	if gid != 0 {
+		must(unix.Setgid(gid))
+	}
+	if uid != 0 {
+		must(unix.Setuid(uid))
+	}
 
-	// Execute the shell as PID 1 inside the container
-	// The -i flag makes the shell interactive
-	must(syscall.Exec("/bin/sh", []string{"sh", "-i"}, os.Environ()))
+	// Execute the image's entrypoint/cmd as PID 1 inside the container,
+	// using its declared environment (plus any -env overrides).
+	argv := spec.argv()
+	bin, err := resolvePath(argv[0], spec.Env)
+	must(err)
+	must(syscall.Exec(bin, argv, spec.Env))
 }
 
 func main() {
 	// Check if this is the child process before parsing flags
 	// The child process is created with "--child" as the first argument
 	if len(os.Args) > 1 && os.Args[1] == "--child" {
-		child(os.Args[2])
+		child(os.Args[2], os.Args[3])
+		return
+	}
+
+	// "net-setup" is a standalone subcommand that provisions the host-side
+	// bridge/NAT rules once, outside of any container lifecycle.
+	if len(os.Args) > 1 && os.Args[1] == "net-setup" {
+		fs := flag.NewFlagSet("net-setup", flag.ExitOnError)
+		bridge := fs.String("bridge", defaultBridge, "name of the bridge to create/configure")
+		cidr := fs.String("cidr", "10.200.1.1/24", "gateway address (with prefix) to assign to the bridge")
+		fs.Parse(os.Args[2:])
+		must(netSetup(*bridge, *cidr))
+		return
+	}
+
+	// "prune" deletes cache blobs that no longer belong to any cached image.
+	if len(os.Args) > 1 && os.Args[1] == "prune" {
+		must(prune())
 		return
 	}
 
 	// Parse command line flags for the parent process
 	img := flag.String("image", "alpine:latest", "OCI image reference to run")
 	userns := flag.Bool("userns", false, "enable user namespace (for rootless containers)")
+	netns := flag.Bool("net", false, "enable a private network namespace connected via a veth pair")
+	bridge := flag.String("bridge", defaultBridge, "host bridge to attach the container's veth to")
+	cidr := flag.String("cidr", "10.200.1.2/24", "IP (with prefix) to assign to the container's eth0")
+	name := flag.String("name", "", "name for the container's cgroup (defaults to the child's PID)")
+	memory := flag.String("memory", "", "memory limit, e.g. 128M (cgroup v2 memory.max)")
+	cpus := flag.Float64("cpus", 0, "fractional CPU limit, e.g. 1.5 (cgroup v2 cpu.max)")
+	pids := flag.Int64("pids", 0, "max number of PIDs (cgroup v2 pids.max)")
+	noCache := flag.Bool("no-cache", false, "re-fetch the image instead of using the on-disk cache")
+	entrypoint := flag.String("entrypoint", "", "override the image's entrypoint")
+	workdir := flag.String("workdir", "", "override the image's working directory")
+	user := flag.String("user", "", "override the image's user, as uid[:gid] or name[:group]")
+	var envFlags envList
+	flag.Var(&envFlags, "env", "additional KEY=VAL environment variable (repeatable)")
 	flag.Parse()
 
-	// Download and prepare the container rootfs
-	root := rootfs(*img)
+	memLimit, err := parseBytes(*memory)
+	must(err)
+
+	// Resolve (downloading/unpacking only what's missing from the cache)
+	// and prepare the container rootfs.
+	root, cfg, err := resolveRootfs(*img, *noCache)
+	must(err)
+
+	// Everything after "--" replaces the image's Cmd, e.g.
+	// "mini_container -image alpine -- ls -la /".
+	spec := buildExecSpec(&cfg.Config, *entrypoint, *workdir, *user, envFlags, flag.Args())
+	encodedSpec, err := encodeExecSpec(spec)
+	must(err)
 
 	// Use clone approach - create child process with new namespaces
 	fmt.Println("Using clone approach for namespace creation")
-	
+
+	// A pipe lets the parent finish host-side setup (moving the veth peer
+	// into the child's netns) before the child configures/brings it up.
+	syncRead, syncWrite, err := os.Pipe()
+	must(err)
+
+	// Allocate a PTY so the container shell gets real job control, window
+	// resize, and ^C handling instead of inheriting the host's raw fds.
+	ptyMaster, ptySlave, err := openPTY()
+	must(err)
+
 	// Create the child process that will run in new namespaces
-	cmd := exec.Command("/proc/self/exe", "--child", root)
-	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd := exec.Command("/proc/self/exe", "--child", root, encodedSpec)
+	cmd.ExtraFiles = []*os.File{syncRead, ptySlave}
+	// The child's stdin/stdout are proxied through the PTY once
+	// becomeController() takes over, but stderr isn't - keep it wired to the
+	// host's so setup failures before that point (Sethostname, setup(),
+	// mount errors, configureChildNetwork) are actually visible instead of
+	// silently going to /dev/null.
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if *netns {
+		cmd.Env = append(cmd.Env, "MC_CIDR="+*cidr)
+	}
+	if *userns {
+		cmd.Env = append(cmd.Env, "MC_ROOTLESS=1")
+	}
 
 	// Configure the namespaces to create
 	// - CLONE_NEWNS: New mount namespace (isolated filesystem view)
@@ -163,15 +168,23 @@ func main() {
 	if *userns {
 		flags |= syscall.CLONE_NEWUSER
 	}
+	if *netns {
+		flags |= syscall.CLONE_NEWNET
+	}
 
 	sysProcAttr := &syscall.SysProcAttr{
 		Cloneflags:   uintptr(flags),
 		Unshareflags: syscall.CLONE_NEWNS, // Make mount tree totally private for security
 	}
 
-	// Only set UID/GID mappings when using user namespace and not running as root
-	// Root doesn't need mappings as it already has all privileges
-	if *userns && os.Getuid() != 0 {
+	// Only set UID/GID mappings when using user namespace and not running as root.
+	// Root doesn't need mappings as it already has all privileges. Prefer the
+	// setuid newuidmap/newgidmap helpers so the container sees its full
+	// delegated subuid/subgid range rather than everyone looking like
+	// "nobody"; fall back to a single-ID self-mapping if they're unavailable.
+	useIDMapHelpers := *userns && os.Getuid() != 0 && idMapHelpersAvailable()
+	if *userns && os.Getuid() != 0 && !useIDMapHelpers {
+		fmt.Println("warning: newuidmap/newgidmap not found, falling back to single-ID mapping (non-root uids will appear as 'nobody')")
 		sysProcAttr.UidMappings = []syscall.SysProcIDMap{{
 			HostID: os.Getuid(), ContainerID: 0, Size: 1,
 		}}
@@ -182,6 +195,65 @@ func main() {
 
 	cmd.SysProcAttr = sysProcAttr
 
+	must(cmd.Start())
+	ptySlave.Close() // the child holds its own copy via ExtraFiles
+
+	// From here on the child is alive and blocked on the sync pipe, so a
+	// must()/log.Fatal would os.Exit without running our defers - closing
+	// syncWrite as a side effect of process death and releasing the child
+	// to run unconfigured and unconstrained. Track cleanups for whatever
+	// setup already succeeded and abort() explicitly instead: kill the
+	// child, run those cleanups, then exit.
+	var cleanups []func()
+	abort := func(err error) {
+		log.Println(err)
+		cmd.Process.Kill()
+		cmd.Process.Wait()
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+		os.Exit(1)
+	}
+
+	if useIDMapHelpers {
+		if err := mapRootlessIDs(cmd.Process.Pid); err != nil {
+			abort(fmt.Errorf("map rootless ids: %w", err))
+		}
+	}
+
+	if *netns {
+		if err := setupVeth(*bridge, cmd.Process.Pid); err != nil {
+			abort(fmt.Errorf("setup veth: %w", err))
+		}
+		cleanups = append(cleanups, teardownVeth)
+	}
+
+	if memLimit > 0 || *cpus > 0 || *pids > 0 {
+		cgroupName := *name
+		if cgroupName == "" {
+			cgroupName = strconv.Itoa(cmd.Process.Pid)
+		}
+		cleanup, err := applyLimits(cgroupName, cmd.Process.Pid, limits{
+			MemoryBytes: memLimit, CPUs: *cpus, Pids: *pids,
+		})
+		if err != nil {
+			abort(fmt.Errorf("apply cgroup limits: %w", err))
+		}
+		cleanups = append(cleanups, cleanup)
+	}
+	// Signal the child that any host-side namespace setup is done.
+	syncWrite.Close()
+
+	restore, err := proxyPTY(ptyMaster)
+	if err != nil {
+		abort(fmt.Errorf("set up pty: %w", err))
+	}
+
 	// Start the container
-	must(cmd.Run())
+	waitErr := cmd.Wait()
+	restore()
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	must(waitErr)
 }
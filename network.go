@@ -0,0 +1,175 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultBridge = "mc-br0"
+	vethHost      = "mc0"
+	vethPeer      = "mc0-peer"
+)
+
+// setupVeth creates a veth pair on the host, attaches the host end to
+// bridge, and moves the peer end into the network namespace of pid. It
+// returns once the peer is visible inside the child's netns; the child is
+// still responsible for renaming/configuring it once it wakes up.
+func setupVeth(bridge string, pid int) error {
+	if bridge == "" {
+		bridge = defaultBridge
+	}
+
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		return fmt.Errorf("bridge %q not found (run 'mini_container net-setup' first): %w", bridge, err)
+	}
+
+	// Clean up a stale veth from a previous crashed run before recreating it.
+	if old, err := netlink.LinkByName(vethHost); err == nil {
+		netlink.LinkDel(old)
+	}
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: vethHost, MasterIndex: br.Attrs().Index},
+		PeerName:  vethPeer,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("create veth pair: %w", err)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		return fmt.Errorf("bring up %s: %w", vethHost, err)
+	}
+
+	peer, err := netlink.LinkByName(vethPeer)
+	if err != nil {
+		return fmt.Errorf("find peer %s: %w", vethPeer, err)
+	}
+	if err := netlink.LinkSetNsPid(peer, pid); err != nil {
+		return fmt.Errorf("move %s into netns of pid %d: %w", vethPeer, pid, err)
+	}
+	return nil
+}
+
+// teardownVeth removes the host-side veth left behind after the container
+// exits. The peer end disappears automatically with the child's netns.
+func teardownVeth() {
+	if link, err := netlink.LinkByName(vethHost); err == nil {
+		netlink.LinkDel(link)
+	}
+}
+
+// configureChildNetwork runs inside the child's network namespace once the
+// parent has finished moving the peer in. It renames the peer to eth0,
+// assigns cidr, and brings up lo/eth0 plus a default route via the bridge.
+func configureChildNetwork(cidr string) error {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("find lo: %w", err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("bring up lo: %w", err)
+	}
+
+	peer, err := netlink.LinkByName(vethPeer)
+	if err != nil {
+		return fmt.Errorf("find %s in child netns: %w", vethPeer, err)
+	}
+	if err := netlink.LinkSetName(peer, "eth0"); err != nil {
+		return fmt.Errorf("rename %s to eth0: %w", vethPeer, err)
+	}
+	eth0, err := netlink.LinkByName("eth0")
+	if err != nil {
+		return fmt.Errorf("find eth0 after rename: %w", err)
+	}
+
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return fmt.Errorf("parse -cidr %q: %w", cidr, err)
+	}
+	if err := netlink.AddrAdd(eth0, addr); err != nil {
+		return fmt.Errorf("assign %s to eth0: %w", cidr, err)
+	}
+	if err := netlink.LinkSetUp(eth0); err != nil {
+		return fmt.Errorf("bring up eth0: %w", err)
+	}
+
+	gw, err := bridgeIP(addr)
+	if err != nil {
+		return err
+	}
+	route := &netlink.Route{LinkIndex: eth0.Attrs().Index, Gw: gw}
+	if err := netlink.RouteAdd(route); err != nil {
+		return fmt.Errorf("add default route via %s: %w", gw, err)
+	}
+	return nil
+}
+
+// bridgeIP assumes the bridge owns the first address of the container's
+// subnet, matching the convention used by net-setup.
+func bridgeIP(addr *netlink.Addr) (net.IP, error) {
+	ip := addr.IPNet.IP.Mask(addr.IPNet.Mask)
+	gw := make(net.IP, len(ip))
+	copy(gw, ip)
+	gw[len(gw)-1]++
+	if !addr.IPNet.Contains(gw) {
+		return nil, fmt.Errorf("computed gateway %s outside of %s", gw, addr.IPNet)
+	}
+	return gw, nil
+}
+
+// netSetup implements the "mini_container net-setup" subcommand: it creates
+// the bridge (if missing), assigns it the gateway address of cidr, enables
+// IP forwarding, and installs a MASQUERADE rule so containers behind it can
+// reach the outside world.
+func netSetup(bridge, cidr string) error {
+	if bridge == "" {
+		bridge = defaultBridge
+	}
+
+	link, err := netlink.LinkByName(bridge)
+	if err != nil {
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridge}}
+		if err := netlink.LinkAdd(br); err != nil {
+			return fmt.Errorf("create bridge %s: %w", bridge, err)
+		}
+		link = br
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("bring up bridge %s: %w", bridge, err)
+	}
+
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return fmt.Errorf("parse -cidr %q: %w", cidr, err)
+	}
+	gw, err := bridgeIP(addr)
+	if err != nil {
+		return err
+	}
+	gwAddr := &netlink.Addr{IPNet: &net.IPNet{IP: gw, Mask: addr.IPNet.Mask}}
+	if err := netlink.AddrAdd(link, gwAddr); err != nil && err.Error() != "file exists" {
+		return fmt.Errorf("assign %s to %s: %w", gwAddr, bridge, err)
+	}
+
+	if err := exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1").Run(); err != nil {
+		return fmt.Errorf("enable ip_forward: %w", err)
+	}
+
+	subnet := addr.IPNet.String()
+	rule := exec.Command("iptables", "-t", "nat", "-C", "POSTROUTING", "-s", subnet, "!", "-o", bridge, "-j", "MASQUERADE")
+	if rule.Run() != nil {
+		add := exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-s", subnet, "!", "-o", bridge, "-j", "MASQUERADE")
+		if out, err := add.CombinedOutput(); err != nil {
+			return fmt.Errorf("install MASQUERADE rule: %w (%s)", err, out)
+		}
+	}
+
+	fmt.Printf("bridge %s ready at %s\n", bridge, gwAddr)
+	return nil
+}
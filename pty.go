@@ -0,0 +1,110 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY opens a fresh pseudo-terminal pair on /dev/ptmx and returns the
+// master (kept by the parent) and slave (handed to the child) as *os.File.
+func openPTY() (master, slave *os.File, err error) {
+	m, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open /dev/ptmx: %w", err)
+	}
+
+	if err := unix.IoctlSetInt(int(m.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		m.Close()
+		return nil, nil, fmt.Errorf("grantpt/unlockpt: %w", err)
+	}
+
+	n, err := unix.IoctlGetInt(int(m.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		m.Close()
+		return nil, nil, fmt.Errorf("TIOCGPTN: %w", err)
+	}
+
+	slavePath := fmt.Sprintf("/dev/pts/%d", n)
+	s, err := os.OpenFile(slavePath, os.O_RDWR, 0)
+	if err != nil {
+		m.Close()
+		return nil, nil, fmt.Errorf("open %s: %w", slavePath, err)
+	}
+	return m, s, nil
+}
+
+// proxyPTY puts the host terminal into raw mode, shuttles bytes between it
+// and the container's PTY master, and forwards SIGWINCH so the container
+// sees host window-resize events. It restores the host termios on return.
+func proxyPTY(master *os.File) (restore func(), err error) {
+	fd := int(os.Stdin.Fd())
+	orig, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		// Not a real terminal (e.g. piped stdin) - skip raw mode entirely.
+		go io.Copy(master, os.Stdin)
+		go io.Copy(os.Stdout, master)
+		return func() {}, nil
+	}
+
+	raw := *orig
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, fmt.Errorf("set raw mode: %w", err)
+	}
+
+	go io.Copy(master, os.Stdin)
+	go io.Copy(os.Stdout, master)
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, unix.SIGWINCH)
+	go func() {
+		resizePTY(master)
+		for range winch {
+			resizePTY(master)
+		}
+	}()
+
+	return func() {
+		signal.Stop(winch)
+		unix.IoctlSetTermios(fd, unix.TCSETS, orig)
+	}, nil
+}
+
+// resizePTY copies the host's current window size onto the PTY master so
+// the container's controlling terminal matches it.
+func resizePTY(master *os.File) {
+	ws, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return
+	}
+	unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, ws)
+}
+
+// becomeController makes slave the controlling terminal of the calling
+// process (which must already be a session leader) and dups it over
+// stdin/stdout/stderr.
+func becomeController(slave *os.File) error {
+	fd := int(slave.Fd())
+	if err := unix.IoctlSetInt(fd, unix.TIOCSCTTY, 0); err != nil {
+		return fmt.Errorf("TIOCSCTTY: %w", err)
+	}
+	for _, std := range []int{0, 1, 2} {
+		if err := unix.Dup2(fd, std); err != nil {
+			return fmt.Errorf("dup2 pty slave onto fd %d: %w", std, err)
+		}
+	}
+	if fd > 2 {
+		slave.Close()
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// devNodes are bind-mounted in from the host rather than created with
+// mknod, since mknod requires CAP_MKNOD and fails in a rootless user
+// namespace.
+var devNodes = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// setup prepares root to be used as the container's new root filesystem and
+// pivots into it: it detaches mount propagation, gives root a private /dev,
+// /dev/pts, /sys and /tmp, then pivot_roots and drops the old root. When
+// rootless is true, steps that require privilege the user namespace doesn't
+// grant (devpts newinstance, mounting sysfs) are skipped.
+func setup(root string, rootless bool) error {
+	// Detach the whole mount tree from the host's propagation so nothing we
+	// do here leaks back out, and so pivot_root's "new root must not share
+	// a mount with the old root" invariant holds.
+	if err := unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("make mount tree private: %w", err)
+	}
+
+	// pivot_root requires that the new root be a mount point; bind-mount it
+	// onto itself to guarantee that even when root is a plain directory.
+	if err := unix.Mount(root, root, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind-mount rootfs onto itself: %w", err)
+	}
+
+	if err := setupDev(root); err != nil {
+		return err
+	}
+	if !rootless {
+		if err := setupDevPts(root); err != nil {
+			return err
+		}
+	}
+	if err := setupProcSysTmp(root, rootless); err != nil {
+		return err
+	}
+
+	return pivot(root)
+}
+
+// setupDev mounts a tmpfs at <root>/dev and populates it with bind-mounted
+// copies of the host's basic device nodes.
+func setupDev(root string) error {
+	dev := filepath.Join(root, "dev")
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", dev, "tmpfs", unix.MS_NOSUID, "mode=0755,size=65536k"); err != nil {
+		return fmt.Errorf("mount tmpfs on %s: %w", dev, err)
+	}
+
+	for _, name := range devNodes {
+		dst := filepath.Join(dev, name)
+		f, err := os.OpenFile(dst, os.O_CREATE, 0666)
+		if err != nil {
+			return fmt.Errorf("create %s: %w", dst, err)
+		}
+		f.Close()
+
+		src := filepath.Join("/dev", name)
+		if err := unix.Mount(src, dst, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind-mount %s onto %s: %w", src, dst, err)
+		}
+	}
+	return nil
+}
+
+// setupDevPts mounts a private devpts instance at <root>/dev/pts and wires
+// /dev/ptmx up to it, so PTYs allocated inside the container stay isolated
+// from the host's.
+func setupDevPts(root string) error {
+	pts := filepath.Join(root, "dev", "pts")
+	if err := os.MkdirAll(pts, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("devpts", pts, "devpts", 0, "newinstance,ptmxmode=0666"); err != nil {
+		return fmt.Errorf("mount devpts on %s: %w", pts, err)
+	}
+	ptmx := filepath.Join(root, "dev", "ptmx")
+	os.Remove(ptmx)
+	if err := os.Symlink("pts/ptmx", ptmx); err != nil {
+		return fmt.Errorf("symlink %s: %w", ptmx, err)
+	}
+	return nil
+}
+
+// setupProcSysTmp mounts /proc, a read-only /sys (skipped when rootless,
+// since mounting sysfs requires privilege the user namespace doesn't have),
+// and a tmpfs on /tmp.
+func setupProcSysTmp(root string, rootless bool) error {
+	proc := filepath.Join(root, "proc")
+	if err := os.MkdirAll(proc, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("proc", proc, "proc", unix.MS_NOSUID|unix.MS_NOEXEC|unix.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("mount proc: %w", err)
+	}
+
+	if !rootless {
+		sys := filepath.Join(root, "sys")
+		if err := os.MkdirAll(sys, 0755); err != nil {
+			return err
+		}
+		if err := unix.Mount("sysfs", sys, "sysfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NOEXEC|unix.MS_NODEV, ""); err != nil {
+			return fmt.Errorf("mount sysfs: %w", err)
+		}
+	}
+
+	tmp := filepath.Join(root, "tmp")
+	if err := os.MkdirAll(tmp, 01777); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", tmp, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("mount tmpfs on /tmp: %w", err)
+	}
+	return nil
+}
+
+// pivot replaces the process's root with newroot via pivot_root, then
+// detaches and removes the old root so it's no longer reachable - this is
+// what actually closes the chroot-escape hole plain Chroot leaves open.
+func pivot(newroot string) error {
+	oldroot := filepath.Join(newroot, ".oldroot")
+	if err := os.MkdirAll(oldroot, 0700); err != nil {
+		return fmt.Errorf("create %s: %w", oldroot, err)
+	}
+
+	if err := unix.PivotRoot(newroot, oldroot); err != nil {
+		return fmt.Errorf("pivot_root %s: %w", newroot, err)
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir to new root: %w", err)
+	}
+
+	oldrootAfterPivot := "/.oldroot"
+	if err := unix.Unmount(oldrootAfterPivot, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount %s: %w", oldrootAfterPivot, err)
+	}
+	if err := os.Remove(oldrootAfterPivot); err != nil {
+		return fmt.Errorf("remove %s: %w", oldrootAfterPivot, err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// subIDRange is one "start:count" entry from /etc/subuid or /etc/subgid.
+type subIDRange struct {
+	start, count int
+}
+
+// readSubIDRange looks up the first /etc/sub{u,g}id entry for name (a
+// username, falling back to a bare uid/gid the way the real files allow).
+func readSubIDRange(path, name string) (subIDRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return subIDRange{}, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || fields[0] != name {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return subIDRange{}, fmt.Errorf("parse %s: %w", path, err)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return subIDRange{}, fmt.Errorf("parse %s: %w", path, err)
+		}
+		return subIDRange{start, count}, nil
+	}
+	return subIDRange{}, fmt.Errorf("no entry for %q in %s", name, path)
+}
+
+// idMapHelpersAvailable reports whether the setuid newuidmap/newgidmap
+// binaries podman/buildah rely on are installed on this host.
+func idMapHelpersAvailable() bool {
+	_, err1 := exec.LookPath("newuidmap")
+	_, err2 := exec.LookPath("newgidmap")
+	return err1 == nil && err2 == nil
+}
+
+// mapRootlessIDs maps the full subuid/subgid ranges delegated to the
+// invoking user into pid's user namespace via newuidmap/newgidmap, so uids
+// other than 0 show up as more than "nobody" inside the container. It must
+// run after cmd.Start() (pid must exist) and before the child does anything
+// that depends on the mapping - callers gate the child on this with a sync
+// pipe.
+func mapRootlessIDs(pid int) error {
+	u, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("look up current user: %w", err)
+	}
+
+	subUID, err := readSubIDRange("/etc/subuid", u.Username)
+	if err != nil {
+		return err
+	}
+	subGID, err := readSubIDRange("/etc/subgid", u.Username)
+	if err != nil {
+		return err
+	}
+
+	hostUID, hostGID := os.Getuid(), os.Getgid()
+	pidStr := strconv.Itoa(pid)
+
+	newuidmap := exec.Command("newuidmap", pidStr,
+		"0", strconv.Itoa(hostUID), "1",
+		"1", strconv.Itoa(subUID.start), strconv.Itoa(subUID.count))
+	if out, err := newuidmap.CombinedOutput(); err != nil {
+		return fmt.Errorf("newuidmap: %w (%s)", err, out)
+	}
+
+	newgidmap := exec.Command("newgidmap", pidStr,
+		"0", strconv.Itoa(hostGID), "1",
+		"1", strconv.Itoa(subGID.start), strconv.Itoa(subGID.count))
+	if out, err := newgidmap.CombinedOutput(); err != nil {
+		return fmt.Errorf("newgidmap: %w (%s)", err, out)
+	}
+
+	return nil
+}